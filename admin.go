@@ -0,0 +1,43 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * admin.go
+ * Administrative endpoints, e.g. for flushing the cache or reloading the
+ * filter lists
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler serves administrative endpoints under its endpoint path.
+type AdminHandler struct {
+	cache    *Cache
+	filter   *Filter
+	endpoint string /* Path under which admin actions are served */
+}
+
+/* ServeHTTP dispatches an administrative request to the appropriate action. */
+func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, h.endpoint) {
+	case "/cache/flush":
+		h.cache.Flush()
+		fmt.Fprintln(w, "cache flushed")
+	case "/filter/reload":
+		if err := h.filter.Reload(); nil != err {
+			log.Printf("Reloading filter lists: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "filter lists reloaded")
+	default:
+		http.NotFound(w, r)
+	}
+}
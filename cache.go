@@ -0,0 +1,250 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * cache.go
+ * In-memory, LRU-evicted response cache with TTL honoring and negative
+ * caching
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/* cacheHitKey is the context key under which a *bool is stashed so Query can report back whether it was answered from cache. */
+type cacheHitKey struct{}
+
+// WithCacheHit returns a context derived from ctx which causes a Cache's
+// Query to record whether it was a cache hit into *hit.
+func WithCacheHit(ctx context.Context, hit *bool) context.Context {
+	return context.WithValue(ctx, cacheHitKey{}, hit)
+}
+
+// DefaultCacheSize is the default number of entries a Cache will hold.
+const DefaultCacheSize = 10000
+
+// DefaultCacheMaxTTL caps how long a positive answer may be cached,
+// regardless of its received TTL.
+const DefaultCacheMaxTTL = time.Hour
+
+// DefaultCacheNegativeTTL is how long NXDOMAIN/NODATA answers are cached,
+// per RFC 2308's suggested default.
+const DefaultCacheNegativeTTL = 5 * time.Minute
+
+/* cacheEntry is what's stored in a Cache's LRU list. */
+type cacheEntry struct {
+	key      string
+	msg      *dns.Msg
+	cachedAt time.Time
+	expires  time.Time
+}
+
+// Cache sits in front of a Querier, caching answers keyed by
+// (qname, qtype, class, and EDNS Client Subnet network, if any), honoring
+// received TTLs and doing RFC 2308 negative caching, with LRU eviction once
+// it holds size entries.
+type Cache struct {
+	upstream Querier
+	maxTTL   time.Duration
+	negTTL   time.Duration
+	size     int
+	metrics  *Metrics
+
+	mu      sync.Mutex
+	entries map[string]*list.Element /* key -> element of lru */
+	lru     *list.List               /* Front is most-recently-used */
+}
+
+// NewCache returns a Cache of the given size which caches positive answers
+// for at most maxTTL and negative (NXDOMAIN/NODATA) answers for negTTL,
+// querying upstream on a miss. metrics may be nil to disable
+// instrumentation.
+func NewCache(
+	size int,
+	maxTTL, negTTL time.Duration,
+	upstream Querier,
+	metrics *Metrics,
+) *Cache {
+	return &Cache{
+		upstream: upstream,
+		maxTTL:   maxTTL,
+		negTTL:   negTTL,
+		size:     size,
+		metrics:  metrics,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Query answers from the cache when possible, falling back to the
+// upstream Querier and caching the result on a miss. Queries carrying an
+// EDNS Client Subnet option are keyed (and so only ever served to) the
+// subnet the option names, since the answer isn't safe to share with
+// clients outside it; this keeps caching effective under -ecs=synthesize,
+// where most or all queries carry one. Queries with Checking Disabled set
+// bypass the cache entirely, since an unvalidated answer isn't safe to
+// serve to a later client that didn't ask to skip validation.
+func (c *Cache) Query(
+	ctx context.Context,
+	qname string,
+	qtype uint16,
+) (*dns.Msg, error) {
+	opts := queryOptions(ctx)
+	if opts.CD {
+		return c.upstream.Query(ctx, qname, qtype)
+	}
+
+	key := cacheKey(qname, qtype, opts.ECS)
+
+	if msg, ok := c.get(key); ok {
+		if hit, ok := ctx.Value(cacheHitKey{}).(*bool); ok {
+			*hit = true
+		}
+		if nil != c.metrics {
+			c.metrics.CacheHits.Inc()
+		}
+		return msg, nil
+	}
+	if nil != c.metrics {
+		c.metrics.CacheMisses.Inc()
+	}
+
+	msg, err := c.upstream.Query(ctx, qname, qtype)
+	if nil != err {
+		return nil, err
+	}
+	c.set(key, msg)
+	return msg, nil
+}
+
+// Flush empties the cache.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru = list.New()
+}
+
+/* get returns the cached message for key, if present and unexpired, with its Answer TTLs counted down by the time elapsed since it was cached, so callers see a monotonically decreasing TTL. */
+func (c *Cache) get(key string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	ent := el.Value.(*cacheEntry)
+	if time.Now().After(ent.expires) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+
+	msg := ent.msg.Copy()
+	age := uint32(time.Since(ent.cachedAt).Seconds())
+	for _, rr := range msg.Answer {
+		h := rr.Header()
+		if h.Ttl <= age {
+			h.Ttl = 0
+		} else {
+			h.Ttl -= age
+		}
+	}
+	return msg, true
+}
+
+/* set stores msg under key, expiring it per its minimum answer TTL (capped at c.maxTTL), or after c.negTTL if it's not a positive answer (NXDOMAIN, NODATA, or any other non-NOERROR reply such as SERVFAIL), evicting the least-recently-used entry if the cache is full. */
+func (c *Cache) set(key string, msg *dns.Msg) {
+	ttl := c.negTTL
+	if isPositive(msg) {
+		if ttl = minTTL(msg); c.maxTTL < ttl {
+			ttl = c.maxTTL
+		}
+	}
+	if 0 == ttl {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	ent := &cacheEntry{
+		key:      key,
+		msg:      msg.Copy(),
+		cachedAt: now,
+		expires:  now.Add(ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = ent
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(ent)
+
+	for c.size < c.lru.Len() {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+/* removeLocked removes el from the cache. c.mu must already be held. */
+func (c *Cache) removeLocked(el *list.Element) {
+	ent := el.Value.(*cacheEntry)
+	delete(c.entries, ent.key)
+	c.lru.Remove(el)
+}
+
+/* isPositive returns false for NXDOMAIN or NODATA answers, per RFC 2308, and for any other non-NOERROR reply. */
+func isPositive(msg *dns.Msg) bool {
+	return dns.RcodeSuccess == msg.Rcode && 0 != len(msg.Answer)
+}
+
+/* minTTL returns the smallest TTL among msg's answers, or 0 if it has none. */
+func minTTL(msg *dns.Msg) time.Duration {
+	var min uint32
+	for i, rr := range msg.Answer {
+		if ttl := rr.Header().Ttl; 0 == i || ttl < min {
+			min = ttl
+		}
+	}
+	return time.Duration(min) * time.Second
+}
+
+/* cacheKey returns the cache key for a qname/qtype pair, lowercasing the name per DNS's case-insensitive comparison rules. The class is always IN, as Resolver doesn't support querying other classes. If ecs is non-nil, the key also includes its network, so a subnet-scoped answer is only ever served back to queries from the same subnet. */
+func cacheKey(qname string, qtype uint16, ecs *dns.EDNS0_SUBNET) string {
+	return fmt.Sprintf(
+		"%s/%d/%d%s",
+		strings.ToLower(dns.Fqdn(qname)),
+		qtype,
+		dns.ClassINET,
+		ecsKeyPart(ecs),
+	)
+}
+
+/* ecsKeyPart returns a cache-key suffix identifying the network named by ecs, masked to its source prefix length, or "" if ecs is nil. */
+func ecsKeyPart(ecs *dns.EDNS0_SUBNET) string {
+	if nil == ecs {
+		return ""
+	}
+	bits := 32
+	addr := ecs.Address
+	if 2 == ecs.Family {
+		bits = 128
+	} else if v4 := addr.To4(); nil != v4 {
+		addr = v4
+	}
+	network := addr.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+	return fmt.Sprintf("/ecs=%s/%d", network, ecs.SourceNetmask)
+}
@@ -0,0 +1,137 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * ecs.go
+ * EDNS(0) Client Subnet handling
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ECSOff disables EDNS Client Subnet handling entirely.
+	ECSOff = "off"
+	// ECSPassthrough forwards the client's own ECS option upstream, if
+	// it sent one in a wire-format query.
+	ECSPassthrough = "passthrough"
+	// ECSSynthesize derives an ECS option from the client's address.
+	ECSSynthesize = "synthesize"
+)
+
+// DefaultECSV4PrefixLen and DefaultECSV6PrefixLen are the default prefix
+// lengths used to synthesize an ECS option, per the common recursive
+// resolver convention.
+const (
+	DefaultECSV4PrefixLen = 24
+	DefaultECSV6PrefixLen = 56
+)
+
+// ECSConfig controls how EDNS Client Subnet options are derived for
+// upstream queries.
+type ECSConfig struct {
+	Mode        string
+	V4PrefixLen uint8
+	V6PrefixLen uint8
+	TrustXFF    bool /* Trust the X-Forwarded-For header for synthesis */
+}
+
+// FromRequest derives the ECS option, if any, to send upstream for an
+// incoming HTTP request. For ECSPassthrough, req should be the decoded
+// wire-format client query, if any; it's ignored otherwise.
+func (c ECSConfig) FromRequest(r *http.Request, req *dns.Msg) *dns.EDNS0_SUBNET {
+	switch c.Mode {
+	case ECSPassthrough:
+		if nil == req {
+			return nil
+		}
+		return extractECS(req)
+	case ECSSynthesize:
+		return c.synthesize(r)
+	default:
+		return nil
+	}
+}
+
+/* synthesize builds an ECS option from the client's address, preferring a trusted X-Forwarded-For header over the connection's remote address. */
+func (c ECSConfig) synthesize(r *http.Request) *dns.EDNS0_SUBNET {
+	addr := r.RemoteAddr
+	if c.TrustXFF {
+		if xff := r.Header.Get("X-Forwarded-For"); "" != xff {
+			addr = xff
+		}
+	}
+	ip := parseClientIP(addr)
+	if nil == ip {
+		return nil
+	}
+
+	e := &dns.EDNS0_SUBNET{
+		Code:        dns.EDNS0SUBNET,
+		SourceScope: 0,
+		Address:     ip,
+	}
+	if v4 := ip.To4(); nil != v4 {
+		e.Family = 1
+		e.SourceNetmask = c.V4PrefixLen
+		e.Address = v4.Mask(net.CIDRMask(int(c.V4PrefixLen), 32))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = c.V6PrefixLen
+		e.Address = ip.Mask(net.CIDRMask(int(c.V6PrefixLen), 128))
+	}
+	return e
+}
+
+/* parseClientIP pulls an IP address out of a host:port, a bare host, or the first address in a comma-separated X-Forwarded-For list. */
+func parseClientIP(addr string) net.IP {
+	if i := strings.IndexByte(addr, ','); -1 != i {
+		addr = addr[:i]
+	}
+	if host, _, err := net.SplitHostPort(addr); nil == err {
+		addr = host
+	}
+	return net.ParseIP(strings.TrimSpace(addr))
+}
+
+/* extractECS returns the EDNS0_SUBNET option from req's OPT record, if it has one. */
+func extractECS(req *dns.Msg) *dns.EDNS0_SUBNET {
+	o := req.IsEdns0()
+	if nil == o {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+/* attachEDNS0 adds an OPT record to m advertising a UDP buffer size large enough for the RR types miekg/dns unlocks (DNSKEY, TLSA, multi-string TXT, etc.), and reflecting opts.DO and opts.ECS, if either is set. An OPT record is always added, not just when DO or ECS are in play, so plain queries also get a useful buffer size instead of being capped at 512 bytes. */
+func attachEDNS0(m *dns.Msg, opts QueryOptions) {
+	m.SetEdns0(dns.DefaultMsgSize, opts.DO)
+	o := m.IsEdns0()
+	if nil != opts.ECS {
+		o.Option = append(o.Option, opts.ECS)
+	}
+}
+
+// ParseECSMode validates a -ecs flag value.
+func ParseECSMode(mode string) (string, error) {
+	switch mode {
+	case ECSOff, ECSPassthrough, ECSSynthesize:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown ECS mode: %v", mode)
+	}
+}
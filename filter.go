@@ -0,0 +1,305 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * filter.go
+ * Blocklist/allowlist query filtering
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultFilterCategory is the category a block-list/allow-list source is
+// given if none is specified with a "category=" prefix.
+const DefaultFilterCategory = "default"
+
+// DefaultFilterRefresh is how often remote block-list/allow-list sources
+// are re-fetched.
+const DefaultFilterRefresh = time.Hour
+
+// filterSourceList is a flag.Value which accumulates repeated -block-list
+// and -allow-list flags.
+type filterSourceList []string
+
+func (f *filterSourceList) String() string { return strings.Join(*f, ",") }
+func (f *filterSourceList) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// blockedTTL is the TTL given to synthesized sinkhole answers. Synthesized
+// NXDOMAIN replies carry no records, and so no TTL.
+const blockedTTL = 60
+
+// filterSource is a single block-list or allow-list source, either a local
+// file path or an http(s) URL, grouped under a category name for logging.
+type filterSource struct {
+	category string
+	location string
+}
+
+// ParseFilterSources turns a list of -block-list/-allow-list flag values,
+// each optionally of the form "category=location", into filterSources.
+func ParseFilterSources(vals []string) []filterSource {
+	srcs := make([]filterSource, 0, len(vals))
+	for _, v := range vals {
+		cat, loc := DefaultFilterCategory, v
+		if i := strings.IndexByte(v, '='); -1 != i {
+			cat, loc = v[:i], v[i+1:]
+		}
+		srcs = append(srcs, filterSource{category: cat, location: loc})
+	}
+	return srcs
+}
+
+// Filter sits in front of a Querier, blocking queries for names which
+// appear in one of its block-list sources (and not in an allow-list
+// source) instead of forwarding them upstream.
+type Filter struct {
+	upstream Querier
+	sinkV4   net.IP
+	sinkV6   net.IP
+	metrics  *Metrics
+
+	blockSources []filterSource
+	allowSources []filterSource
+
+	mu    sync.RWMutex
+	block map[string]string /* domain -> category */
+	allow map[string]struct{}
+}
+
+// NewFilter returns a Filter which consults blockSources and allowSources,
+// forwarding queries which aren't blocked to upstream. If sinkV4/sinkV6
+// are non-nil, blocked A/AAAA queries are answered with them instead of
+// NXDOMAIN. metrics may be nil to disable instrumentation.
+func NewFilter(
+	blockSources, allowSources []filterSource,
+	sinkV4, sinkV6 net.IP,
+	upstream Querier,
+	metrics *Metrics,
+) (*Filter, error) {
+	f := &Filter{
+		upstream:     upstream,
+		sinkV4:       sinkV4,
+		sinkV6:       sinkV6,
+		metrics:      metrics,
+		blockSources: blockSources,
+		allowSources: allowSources,
+	}
+	if err := f.Reload(); nil != err {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Refresh periodically calls f.Reload every interval, logging (rather than
+// returning) any error, until stop is closed.
+func (f *Filter) Refresh(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := f.Reload(); nil != err {
+				log.Printf("Reloading filter lists: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reload re-fetches every block-list and allow-list source and replaces
+// the in-memory sets atomically.
+func (f *Filter) Reload() error {
+	block, err := loadDomains(f.blockSources)
+	if nil != err {
+		return fmt.Errorf("loading block lists: %w", err)
+	}
+	allowList, err := loadDomains(f.allowSources)
+	if nil != err {
+		return fmt.Errorf("loading allow lists: %w", err)
+	}
+	allow := make(map[string]struct{}, len(allowList))
+	for d := range allowList {
+		allow[d] = struct{}{}
+	}
+
+	f.mu.Lock()
+	f.block = block
+	f.allow = allow
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Query checks qname against the filter's lists, answering blocked queries
+// with NXDOMAIN (or a sinkhole address) rather than forwarding them.
+func (f *Filter) Query(
+	ctx context.Context,
+	qname string,
+	qtype uint16,
+) (*dns.Msg, error) {
+	if cat, blocked := f.check(qname); blocked {
+		log.Printf(
+			"Blocked %v %v (%v)",
+			qname,
+			dns.TypeToString[qtype],
+			cat,
+		)
+		if nil != f.metrics {
+			f.metrics.Blocked.WithLabelValues(cat).Inc()
+		}
+		return f.blockedMsg(qname, qtype), nil
+	}
+	return f.upstream.Query(ctx, qname, qtype)
+}
+
+/* check reports whether qname matches a block-list entry and isn't overridden by an allow-list entry, per the category it matched under. */
+func (f *Filter) check(qname string) (category string, blocked bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(dns.Fqdn(qname)), ".")
+	if matchSuffix(f.allow, name) {
+		return "", false
+	}
+	for {
+		if cat, ok := f.block[name]; ok {
+			return cat, true
+		}
+		i := strings.IndexByte(name, '.')
+		if -1 == i {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+/* matchSuffix reports whether name, or one of its parent domains, is a key in m. */
+func matchSuffix(m map[string]struct{}, name string) bool {
+	for {
+		if _, ok := m[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if -1 == i {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+/* blockedMsg synthesizes the reply for a blocked query: NXDOMAIN, or for an A/AAAA query when a sinkhole address is configured, a single answer pointing there. */
+func (f *Filter) blockedMsg(qname string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	m.Response = true
+	m.RecursionAvailable = true
+
+	var sink net.IP
+	switch qtype {
+	case dns.TypeA:
+		sink = f.sinkV4
+	case dns.TypeAAAA:
+		sink = f.sinkV6
+	}
+	if nil == sink {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(qname),
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    blockedTTL,
+	}
+	if dns.TypeA == qtype {
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: sink}}
+	} else {
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: sink}}
+	}
+	return m
+}
+
+/* loadDomains fetches every source and returns the union of the domains they list, mapped to the category of whichever source listed them. */
+func loadDomains(srcs []filterSource) (map[string]string, error) {
+	domains := make(map[string]string)
+	for _, src := range srcs {
+		data, err := fetchSource(src.location)
+		if nil != err {
+			return nil, fmt.Errorf("fetching %v: %w", src.location, err)
+		}
+		for _, d := range parseDomainList(data) {
+			domains[d] = src.category
+		}
+	}
+	return domains, nil
+}
+
+/* fetchSource reads an http(s) URL or local file into memory. */
+func fetchSource(location string) ([]byte, error) {
+	if strings.HasPrefix(location, "http://") ||
+		strings.HasPrefix(location, "https://") {
+		c := http.Client{Timeout: 30 * time.Second}
+		resp, err := c.Get(location)
+		if nil != err {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if http.StatusOK != resp.StatusCode {
+			return nil, fmt.Errorf("status %v", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	return os.ReadFile(location)
+}
+
+/* parseDomainList parses data as either hosts(5) format (an address followed by one or more hostnames) or plain one-domain-per-line format, ignoring blank lines and "#"-prefixed comments, and returns the domains found. */
+func parseDomainList(data []byte) []string {
+	var domains []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); -1 != i {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if 0 == len(fields) {
+			continue
+		}
+		if nil != net.ParseIP(fields[0]) {
+			/* hosts(5) line: address followed by hostnames */
+			for _, h := range fields[1:] {
+				domains = append(domains, normalizeDomain(h))
+			}
+			continue
+		}
+		domains = append(domains, normalizeDomain(fields[0]))
+	}
+	return domains
+}
+
+/* normalizeDomain lowercases d and strips any trailing dot, matching the normalization Filter.check applies to query names, so blocklist/allowlist entries match regardless of case or trailing-dot style. */
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
@@ -0,0 +1,68 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * metrics.go
+ * Prometheus metrics
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the Prometheus collectors used throughout the server.
+type Metrics struct {
+	Queries         prometheus.Counter
+	CacheHits       prometheus.Counter
+	CacheMisses     prometheus.Counter
+	Blocked         *prometheus.CounterVec /* By block-list category */
+	UpstreamLatency prometheus.Histogram
+	Rcodes          *prometheus.CounterVec /* By RCODE */
+	RRTypes         *prometheus.CounterVec /* By RR type */
+}
+
+// NewMetrics registers and returns the server's Prometheus collectors.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Queries: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "queries_total",
+			Help:      "Total number of queries answered.",
+		}),
+		CacheHits: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "cache_hits_total",
+			Help:      "Total number of queries answered from cache.",
+		}),
+		CacheMisses: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "cache_misses_total",
+			Help:      "Total number of queries not found in cache.",
+		}),
+		Blocked: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "blocked_queries_total",
+			Help:      "Total number of queries blocked, by category.",
+		}, []string{"category"}),
+		UpstreamLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "simpledohserver",
+			Name:      "upstream_latency_seconds",
+			Help:      "Latency of queries to upstream DNS servers.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		Rcodes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "responses_total",
+			Help:      "Total number of responses sent, by RCODE.",
+		}, []string{"rcode"}),
+		RRTypes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "simpledohserver",
+			Name:      "queries_by_type_total",
+			Help:      "Total number of queries answered, by RR type.",
+		}, []string{"qtype"}),
+	}
+}
@@ -0,0 +1,144 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * resolver.go
+ * Upstream resolution via github.com/miekg/dns
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultUpstreams is used to populate the -upstream flag's default value.
+const DefaultUpstreams = "1.1.1.1:53,8.8.8.8:53"
+
+// Querier looks up a qname/qtype pair and returns the reply. Resolver,
+// Cache, and Filter all implement it, so each can transparently sit in
+// front of the next.
+type Querier interface {
+	Query(ctx context.Context, qname string, qtype uint16) (*dns.Msg, error)
+}
+
+/* queryOptionsKey is the context key under which a QueryOptions is stashed. */
+type queryOptionsKey struct{}
+
+// QueryOptions carries the client-requested bits which should be forwarded
+// to the upstream server for a particular query.
+type QueryOptions struct {
+	DO  bool              /* DNSSEC OK */
+	CD  bool              /* Checking Disabled */
+	ECS *dns.EDNS0_SUBNET /* Client subnet to forward, if any */
+}
+
+// WithQueryOptions returns a context derived from ctx carrying opts, for
+// Resolver.Query to forward upstream.
+func WithQueryOptions(ctx context.Context, opts QueryOptions) context.Context {
+	return context.WithValue(ctx, queryOptionsKey{}, opts)
+}
+
+/* queryOptions returns the QueryOptions stashed in ctx, or the zero value if none were set. */
+func queryOptions(ctx context.Context) QueryOptions {
+	opts, _ := ctx.Value(queryOptionsKey{}).(QueryOptions)
+	return opts
+}
+
+// Resolver sends queries to a configurable list of upstream DNS servers. It
+// round-robins between them, failing over to the next upstream if one
+// doesn't answer.
+type Resolver struct {
+	servers   []string
+	client    *dns.Client
+	tcpClient *dns.Client /* Used to retry truncated UDP replies */
+	metrics   *Metrics
+	next      uint32 /* Index of the next server to try, incremented atomically */
+}
+
+// NewResolver returns a Resolver which queries the given upstream servers,
+// which should be in host:port form. metrics may be nil to disable
+// instrumentation.
+func NewResolver(servers []string, metrics *Metrics) (*Resolver, error) {
+	if 0 == len(servers) {
+		return nil, fmt.Errorf("no upstream servers given")
+	}
+	return &Resolver{
+		servers: servers,
+		client:  &dns.Client{UDPSize: dns.DefaultMsgSize},
+		tcpClient: &dns.Client{
+			Net: "tcp",
+		},
+		metrics: metrics,
+	}, nil
+}
+
+// Query sends a query for qname/qtype to the upstream servers, in
+// round-robin order, returning the first successful reply.
+func (r *Resolver) Query(
+	ctx context.Context,
+	qname string,
+	qtype uint16,
+) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	m.RecursionDesired = true
+
+	opts := queryOptions(ctx)
+	m.CheckingDisabled = opts.CD
+	attachEDNS0(m, opts)
+
+	start := int(atomic.AddUint32(&r.next, 1) - 1)
+	tStart := time.Now()
+	var lastErr error
+	for i := range r.servers {
+		server := r.servers[(start+i)%len(r.servers)]
+		reply, _, err := r.client.ExchangeContext(ctx, m, server)
+		if nil == err && reply.Truncated {
+			reply, _, err = r.tcpClient.ExchangeContext(ctx, m, server)
+		}
+		if nil == err {
+			if nil != r.metrics {
+				r.metrics.UpstreamLatency.Observe(
+					time.Since(tStart).Seconds(),
+				)
+			}
+			return reply, nil
+		}
+		lastErr = fmt.Errorf("querying %v: %w", server, err)
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
+}
+
+// ParseQType turns a query-type string, either an RR type name such as
+// "AAAA" or its numeric value such as "28", into the numeric RR type.
+func ParseQType(qtype string) (uint16, error) {
+	if n, err := strconv.ParseUint(qtype, 10, 16); nil == err {
+		return uint16(n), nil
+	}
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported query type: %v", qtype)
+	}
+	return t, nil
+}
+
+// ParseUpstreams splits a comma-separated list of upstream addresses, as
+// given to the -upstream flag, into a slice.
+func ParseUpstreams(s string) []string {
+	var us []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); "" != u {
+			us = append(us, u)
+		}
+	}
+	return us
+}
@@ -6,21 +6,26 @@ package main
  * Simple DNS over HTTPS server
  * By J. Stuart McMurray
  * Created 20181028
- * Last Modified 20181030
+ * Last Modified 20260727
  */
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -37,6 +42,13 @@ const (
 	// PRETTY if sent as part of the query will cause the returned JSON
 	// to be pretty-printed.
 	PRETTY = "pp"
+
+	// CDPARAM if sent as part of the query, with any value, sets the
+	// Checking Disabled bit on the upstream query.
+	CDPARAM = "cd"
+	// DOPARAM if sent as part of the query, with any value, sets the
+	// DNSSEC OK bit on the upstream query.
+	DOPARAM = "do"
 )
 
 // Response is the answer we send back to clients
@@ -76,10 +88,13 @@ type Answer struct {
 
 // Handler handles DoH queries
 type Handler struct {
-	ctype    string /* Default content type */
-	ttl      uint   /* TTL to return */
-	verbose  bool   /* Verbose logging */
-	endpoint string /* REST endpoint */
+	ctype    string       /* Default content type */
+	resolver Querier      /* Upstream resolver, possibly cached */
+	metrics  *Metrics     /* May be nil */
+	logger   *slog.Logger /* Structured request logger */
+	ecs      ECSConfig    /* EDNS Client Subnet handling */
+	verbose  bool         /* Verbose logging */
+	endpoint string       /* REST endpoint */
 }
 
 /* ServeHTTP handles requests for resolution */
@@ -123,11 +138,22 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", ctype)
 
 	/* Do the lookup */
-	ans, code, err := h.Lookup(qname, qtype)
+	start := time.Now()
+	var cacheHit bool
+	ctx := WithCacheHit(r.Context(), &cacheHit)
+	_, cd := r.Form[CDPARAM]
+	_, do := r.Form[DOPARAM]
+	ctx = WithQueryOptions(ctx, QueryOptions{
+		CD:  cd,
+		DO:  do,
+		ECS: h.ecs.FromRequest(r, nil),
+	})
+	ans, code, err := h.Lookup(ctx, qname, qtype)
 	if nil != err {
 		h.Error(w, r, err.Error(), code)
 		return
 	}
+	h.observe(ans.Question[0].Type, ans.Status)
 
 	/* If we're meant to make it pretty, do so */
 	var res []byte
@@ -143,123 +169,72 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	/* Send it back */
 	if h.verbose {
-		log.Printf(
-			"[%v] %v %v %v %v %q",
-			r.RemoteAddr,
-			http.StatusOK,
-			r.Method,
-			r.Host,
-			r.URL,
-			ans.answerData(),
+		h.logger.Info(
+			"query",
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"host", r.Host,
+			"name", qname,
+			"qtype", qtype,
+			"status", http.StatusOK,
+			"rcode", dns.RcodeToString[int(ans.Status)],
+			"cache_hit", cacheHit,
+			"latency", time.Since(start),
 		)
 	}
 	w.Write(res)
 	w.Write([]byte("\n"))
 }
 
+/* observe records qtype/rcode metrics for a completed query, if metrics are enabled. */
+func (h Handler) observe(qtype, rcode uint) {
+	if nil == h.metrics {
+		return
+	}
+	h.metrics.Queries.Inc()
+	h.metrics.RRTypes.WithLabelValues(dns.TypeToString[uint16(qtype)]).Inc()
+	h.metrics.Rcodes.WithLabelValues(dns.RcodeToString[int(rcode)]).Inc()
+}
+
 // Lookup performs a lookup for the given name and type and returns a Response
 // struct.
-func (h Handler) Lookup(qname, qtype string) (Response, int, error) {
-	var (
-		res = Response{
-			TC:       false,
-			RD:       true,
-			RA:       true,
-			AD:       false,
-			CD:       false,
-			Question: []Question{{Name: qname}},
-		} /* Response to send back */
-		qn  uint     /* QType as a number */
-		as  []string /* Answers from upstream */
-		err error
-	)
+func (h Handler) Lookup(
+	ctx context.Context,
+	qname, qtype string,
+) (Response, int, error) {
+	qn, err := ParseQType(qtype)
+	if nil != err {
+		return Response{}, http.StatusNotImplemented, err
+	}
 
 	/* Proxy lookup upstream */
-	switch strings.ToLower(qtype) {
-	case "1", "a":
-		qn = 1
-		ips, e := net.LookupIP(qname)
-		err = e
-		/* Filter out AAAA records */
-		as = make([]string, 0, len(ips))
-		for _, ip := range ips {
-			if f := ip.To4(); nil != f {
-				as = append(as, f.String())
-			}
-		}
-	case "2", "ns":
-		qn = 2
-		/* Because really what we need is a struct around a string */
-		nss, e := net.LookupNS(qname)
-		err = e
-		as = make([]string, len(nss))
-		for i, ns := range nss {
-			as[i] = ns.Host
-		}
-	case "5", "cname":
-		qn = 5
-		as = make([]string, 1)
-		as[0], err = net.LookupCNAME(qname)
-	case "12", "ptr":
-		qn = 12
-		as, err = net.LookupAddr(qname)
-	case "15", "mx":
-		qn = 15
-		mxs, e := net.LookupMX(qname)
-		err = e
-		/* Stringify the MX records */
-		as = make([]string, len(mxs))
-		for i, mx := range mxs {
-			as[i] = fmt.Sprintf("%v %v", mx.Pref, mx.Host)
-		}
-	case "16", "txt":
-		qn = 16
-		as, err = net.LookupTXT(qname)
-	case "28", "aaaa":
-		qn = 28
-		ips, e := net.LookupIP(qname)
-		err = e
-		/* Filter out A records */
-		as = make([]string, 0, len(ips))
-		for _, ip := range ips {
-			if f := ip.To4(); nil == f {
-				as = append(as, ip.String())
-			}
-		}
-	case "33", "srv":
-		qn = 33
-		_, srvs, e := net.LookupSRV("", "", qname)
-		err = e
-		/* Unroll the SRV records */
-		as = make([]string, len(srvs))
-		for i, srv := range srvs {
-			as[i] = fmt.Sprintf(
-				"%v %v %v %v",
-				srv.Priority,
-				srv.Weight,
-				srv.Port,
-				srv.Target,
-			)
-		}
-	default:
-		return res, http.StatusNotImplemented, errors.New(
-			"unsupported query type: " + qtype,
-		)
-	}
+	reply, err := h.resolver.Query(ctx, qname, qn)
 	if nil != err {
-		return res, http.StatusInternalServerError, err
+		return Response{}, http.StatusInternalServerError, err
 	}
 
-	/* Fill in the rest of the question section */
-	res.Question[0].Type = qn
+	res := Response{
+		Status: uint(reply.Rcode),
+		TC:     reply.Truncated,
+		RD:     reply.RecursionDesired,
+		RA:     reply.RecursionAvailable,
+		AD:     reply.AuthenticatedData,
+		CD:     reply.CheckingDisabled,
+		Question: []Question{{
+			Name: qname,
+			Type: uint(qn),
+		}},
+	}
 
-	/* Add the answers */
-	for _, a := range as {
+	/* Add the answers, rendered as their zone-file representation so
+	arbitrary RR types work without per-type code. */
+	for _, rr := range reply.Answer {
+		rh := rr.Header()
 		res.Answer = append(res.Answer, Answer{
-			Name: qname,
-			Type: qn,
-			TTL:  h.ttl,
-			Data: a,
+			Name: strings.TrimSuffix(rh.Name, "."),
+			Type: uint(rh.Rrtype),
+			TTL:  uint(rh.Ttl),
+			Data: rr.String(),
 		})
 	}
 
@@ -281,15 +256,15 @@ func (h Handler) Error(
 
 	/* Log a message if we're meant to */
 	if h.verbose {
-		log.Printf(
-			"[%v] %v %v %v %v %v (error number %02x)",
-			r.RemoteAddr,
-			status,
-			r.Method,
-			r.Host,
-			r.URL,
-			msg,
-			enum,
+		h.logger.Error(
+			"request error",
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"host", r.Host,
+			"url", r.URL.String(),
+			"status", status,
+			"msg", msg,
+			"error_id", fmt.Sprintf("%02x", enum),
 		)
 	}
 	http.Error(w, fmt.Sprintf("Error number %02x", enum), status)
@@ -334,10 +309,51 @@ func main() {
 			"application/json",
 			"The default `MIME type` to send in responses",
 		)
-		ttl = flag.Uint(
-			"ttl",
-			1800,
-			"TTL to return to clients, in `seconds`",
+		upstream = flag.String(
+			"upstream",
+			DefaultUpstreams,
+			"Comma-separated `list` of upstream DNS servers, "+
+				"in host:port form",
+		)
+		cacheSize = flag.Int(
+			"cache-size",
+			DefaultCacheSize,
+			"Maximum `number` of responses to cache",
+		)
+		cacheMaxTTL = flag.Duration(
+			"cache-max-ttl",
+			DefaultCacheMaxTTL,
+			"Maximum `duration` to cache a positive response, "+
+				"regardless of its TTL",
+		)
+		cacheNegTTL = flag.Duration(
+			"cache-negative-ttl",
+			DefaultCacheNegativeTTL,
+			"`Duration` to cache NXDOMAIN/NODATA responses",
+		)
+		blockSinkV4 = flag.String(
+			"block-sink-v4",
+			"",
+			"If set, answer blocked A queries with this `address` "+
+				"instead of NXDOMAIN",
+		)
+		blockSinkV6 = flag.String(
+			"block-sink-v6",
+			"",
+			"If set, answer blocked AAAA queries with this "+
+				"`address` instead of NXDOMAIN",
+		)
+		filterRefresh = flag.Duration(
+			"filter-refresh",
+			DefaultFilterRefresh,
+			"`Interval` on which to re-fetch remote block/allow "+
+				"lists",
+		)
+		metricsAddr = flag.String(
+			"metrics-addr",
+			NO,
+			"Listen `address` for Prometheus metrics on /metrics, "+
+				"or \""+NO+"\" to disable",
 		)
 		verbOn = flag.Bool(
 			"v",
@@ -349,6 +365,63 @@ func main() {
 			"/resolve",
 			"REST endpoint `path` to serve",
 		)
+		wireEndpoint = flag.String(
+			"wire-endpoint",
+			"/dns-query",
+			"RFC 8484 wire-format endpoint `path` to serve",
+		)
+		adminAddr = flag.String(
+			"admin-addr",
+			NO,
+			"Listen `address` for administrative endpoints "+
+				"(cache flush, filter reload), or \""+NO+
+				"\" to disable; not served on -http/-https/-fcgi",
+		)
+		adminEndpoint = flag.String(
+			"admin-endpoint",
+			"/admin",
+			"Administrative endpoint `path`, under which "+
+				"/cache/flush and /filter/reload are served "+
+				"on -admin-addr",
+		)
+		ecsMode = flag.String(
+			"ecs",
+			ECSOff,
+			"EDNS Client Subnet handling: \""+ECSOff+"\", \""+
+				ECSPassthrough+"\", or \""+ECSSynthesize+"\"",
+		)
+		ecsV4Prefix = flag.Int(
+			"ecs-v4-prefix",
+			DefaultECSV4PrefixLen,
+			"Prefix `length` to use when synthesizing an IPv4 "+
+				"EDNS Client Subnet",
+		)
+		ecsV6Prefix = flag.Int(
+			"ecs-v6-prefix",
+			DefaultECSV6PrefixLen,
+			"Prefix `length` to use when synthesizing an IPv6 "+
+				"EDNS Client Subnet",
+		)
+		trustXFF = flag.Bool(
+			"trust-xff",
+			false,
+			"Trust the X-Forwarded-For header when synthesizing "+
+				"an EDNS Client Subnet",
+		)
+		blockLists filterSourceList
+		allowLists filterSourceList
+	)
+	flag.Var(
+		&blockLists,
+		"block-list",
+		"Block-list `source` (file path or URL), optionally "+
+			"prefixed \"category=\"; may be given more than once",
+	)
+	flag.Var(
+		&allowLists,
+		"allow-list",
+		"Allow-list `source` (file path or URL), optionally "+
+			"prefixed \"category=\"; may be given more than once",
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -365,7 +438,16 @@ type:         The resource record type to return
 content-type: A custom Content-Type to use in the reply
 pp:           Causes the response to be pretty-printed (i.e. indented)
 
-Only queries of type A, NS, PTR, MX, TXT, AAAA, and SRV are supported
+RFC 8484 wire-format (application/dns-message) queries are also served, on
+the wire-endpoint path, as either a GET with the query in the dns parameter
+base64url-encoded, or a POST with the query as the request body.
+
+Arbitrary RR types understood by the upstream resolvers are supported.
+
+The -ecs flag controls whether an EDNS Client Subnet option is sent to
+upstream resolvers: "off" sends none, "passthrough" forwards the client's
+own option (wire-format queries only), and "synthesize" derives one from
+the client's address.
 
 Options:
 `,
@@ -375,19 +457,88 @@ Options:
 	}
 	flag.Parse()
 
-	/* Register handler */
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	metrics := NewMetrics()
+
+	mode, err := ParseECSMode(*ecsMode)
+	if nil != err {
+		log.Fatalf("ECS mode: %v", err)
+	}
+	ecs := ECSConfig{
+		Mode:        mode,
+		V4PrefixLen: uint8(*ecsV4Prefix),
+		V6PrefixLen: uint8(*ecsV6Prefix),
+		TrustXFF:    *trustXFF,
+	}
+
+	/* Set up the upstream resolver, the cache in front of it, and the
+	block/allow-list filter in front of that */
+	resolver, err := NewResolver(ParseUpstreams(*upstream), metrics)
+	if nil != err {
+		log.Fatalf("Upstream resolver: %v", err)
+	}
+	cache := NewCache(
+		*cacheSize,
+		*cacheMaxTTL,
+		*cacheNegTTL,
+		resolver,
+		metrics,
+	)
+	filter, err := NewFilter(
+		ParseFilterSources(blockLists),
+		ParseFilterSources(allowLists),
+		net.ParseIP(*blockSinkV4),
+		net.ParseIP(*blockSinkV6),
+		cache,
+		metrics,
+	)
+	if nil != err {
+		log.Fatalf("Filter: %v", err)
+	}
+	if 0 < *filterRefresh {
+		go filter.Refresh(*filterRefresh, nil)
+	}
+
+	/* Register handlers */
 	http.Handle(*endpoint, Handler{
 		ctype:    *contentType,
-		ttl:      *ttl,
+		resolver: filter,
+		metrics:  metrics,
+		logger:   logger,
+		ecs:      ecs,
 		verbose:  *verbOn,
 		endpoint: *endpoint,
 	})
+	http.Handle(*wireEndpoint, WireHandler{
+		Handler: Handler{
+			resolver: filter,
+			metrics:  metrics,
+			logger:   logger,
+			ecs:      ecs,
+			verbose:  *verbOn,
+		},
+		endpoint: *wireEndpoint,
+	})
 
 	/* Listen and serve */
 	ech := make(chan error)
 	go serveHTTP(ech, *httpAddr)
 	go serveHTTPS(ech, *httpsAddr, *cert, *key)
 	go serveFCGI(ech, *fcgiAddr, *removeSock)
+	if NO != *metricsAddr && "" != *metricsAddr {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go serveMetrics(ech, *metricsAddr, mux)
+	}
+	if NO != *adminAddr && "" != *adminAddr {
+		mux := http.NewServeMux()
+		mux.Handle(*adminEndpoint+"/", AdminHandler{
+			cache:    cache,
+			filter:   filter,
+			endpoint: *adminEndpoint,
+		})
+		go serveAdmin(ech, *adminAddr, mux)
+	}
 
 	log.Fatalf("Fatalf error: %v", <-ech)
 }
@@ -408,6 +559,38 @@ func serveHTTP(ech chan<- error, addr string) {
 	ech <- http.Serve(l, nil)
 }
 
+/* serveMetrics serves Prometheus metrics */
+func serveMetrics(ech chan<- error, addr string, mux http.Handler) {
+	if "" == addr || NO == addr {
+		return
+	}
+	/* Listen */
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		ech <- err
+		return
+	}
+	log.Printf("Serving metrics requests on %v", l.Addr())
+	/* Serve */
+	ech <- http.Serve(l, mux)
+}
+
+/* serveAdmin serves administrative requests (cache flush, filter reload) */
+func serveAdmin(ech chan<- error, addr string, mux http.Handler) {
+	if "" == addr || NO == addr {
+		return
+	}
+	/* Listen */
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		ech <- err
+		return
+	}
+	log.Printf("Serving admin requests on %v", l.Addr())
+	/* Serve */
+	ech <- http.Serve(l, mux)
+}
+
 /* serveHTTPS responds to HTTPS queries */
 func serveHTTPS(ech chan<- error, addr, cert, key string) {
 	if "" == addr || NO == addr {
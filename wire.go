@@ -0,0 +1,156 @@
+// Program simpledohserver implements a simple DNS over HTTPS server
+package main
+
+/*
+ * wire.go
+ * RFC 8484 wire-format (application/dns-message) DoH handler
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxWireMessageSize is the largest DNS message RFC 8484 allows a client to
+// send over DoH.
+const maxWireMessageSize = 65535
+
+// WireHandler handles DoH queries sent in RFC 8484 wire format, as opposed
+// to the JSON format served by Handler.
+type WireHandler struct {
+	Handler         /* Embedded for its resolver, Error, and verbose logging */
+	endpoint string /* REST endpoint */
+}
+
+/* ServeHTTP handles RFC 8484 wire-format requests for resolution */
+func (h WireHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	/* Only serve the one path */
+	if h.endpoint != r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	/* Pull the DNS query out of the request */
+	req, err := h.readMsg(r)
+	if nil != err {
+		h.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if 1 != len(req.Question) {
+		h.Error(w, r, "exactly one question required", http.StatusBadRequest)
+		return
+	}
+	q := req.Question[0]
+
+	/* Do the lookup, keeping the upstream's RRs verbatim rather than
+	going through the JSON-oriented Answer type */
+	start := time.Now()
+	var cacheHit bool
+	ctx := WithCacheHit(r.Context(), &cacheHit)
+	var do bool
+	if o := req.IsEdns0(); nil != o {
+		do = o.Do()
+	}
+	ctx = WithQueryOptions(ctx, QueryOptions{
+		DO:  do,
+		CD:  req.CheckingDisabled,
+		ECS: h.ecs.FromRequest(r, req),
+	})
+	reply, err := h.resolver.Query(ctx, q.Name, q.Qtype)
+	if nil != err {
+		h.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.observe(uint(q.Qtype), uint(reply.Rcode))
+
+	/* Build the wire-format reply */
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Rcode = reply.Rcode
+	res.Answer = reply.Answer
+	res.Ns = reply.Ns
+	res.Extra = reply.Extra
+	res.AuthenticatedData = reply.AuthenticatedData
+	res.CheckingDisabled = reply.CheckingDisabled
+	res.RecursionAvailable = reply.RecursionAvailable
+	res.Truncated = reply.Truncated
+
+	var minTTL uint32
+	for i, rr := range res.Answer {
+		if 0 == i || rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+		}
+	}
+
+	packed, err := res.Pack()
+	if nil != err {
+		h.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	/* Send it back */
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL))
+	if h.verbose {
+		h.logger.Info(
+			"query",
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"host", r.Host,
+			"name", q.Name,
+			"qtype", dns.TypeToString[q.Qtype],
+			"status", http.StatusOK,
+			"rcode", dns.RcodeToString[res.Rcode],
+			"cache_hit", cacheHit,
+			"latency", time.Since(start),
+		)
+	}
+	w.Write(packed)
+}
+
+/* readMsg extracts the DNS query from a wire-format DoH request: a GET with a dns= query parameter holding a base64url-encoded message, or a POST with an application/dns-message body holding a raw one. */
+func (h WireHandler) readMsg(r *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		enc := r.URL.Query().Get("dns")
+		if "" == enc {
+			return nil, errors.New("no dns query parameter provided")
+		}
+		b, err := base64.RawURLEncoding.DecodeString(enc)
+		if nil != err {
+			return nil, fmt.Errorf("decoding dns parameter: %w", err)
+		}
+		buf = b
+	case http.MethodPost:
+		if "application/dns-message" != r.Header.Get("Content-Type") {
+			return nil, errors.New("unsupported content-type")
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxWireMessageSize+1))
+		if nil != err {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+		buf = b
+	default:
+		return nil, errors.New("unsupported method: " + r.Method)
+	}
+	if maxWireMessageSize < len(buf) {
+		return nil, errors.New("message too large")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); nil != err {
+		return nil, fmt.Errorf("unpacking dns message: %w", err)
+	}
+	return m, nil
+}